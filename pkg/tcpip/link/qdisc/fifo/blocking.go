@@ -0,0 +1,47 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import (
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// acquireSlot blocks until qd has a free queue slot to offer WritePacket, the
+// discipline closes, or timeout elapses (timeout <= 0 waits indefinitely).
+// It returns nil once a slot has been reserved (the caller must enqueue
+// exactly one packet to consume it), or the tcpip.Error WritePacket should
+// return otherwise. qd.freeSlots must be non-nil; see WithBlockingWrite.
+func (qd *queueDispatcher) acquireSlot(timeout time.Duration, closedCh <-chan struct{}) tcpip.Error {
+	if timeout <= 0 {
+		select {
+		case <-qd.freeSlots:
+			return nil
+		case <-closedCh:
+			return &tcpip.ErrClosedForSend{}
+		}
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-qd.freeSlots:
+		return nil
+	case <-closedCh:
+		return &tcpip.ErrClosedForSend{}
+	case <-t.C:
+		return &tcpip.ErrNoBufferSpace{}
+	}
+}
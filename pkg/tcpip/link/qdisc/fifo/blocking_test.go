@@ -0,0 +1,59 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import (
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+func TestAcquireSlotSucceedsWhenSlotFree(t *testing.T) {
+	qd := &queueDispatcher{freeSlots: make(chan struct{}, 1)}
+	qd.freeSlots <- struct{}{}
+	if err := qd.acquireSlot(0, make(chan struct{})); err != nil {
+		t.Fatalf("acquireSlot() = %v, want nil", err)
+	}
+}
+
+func TestAcquireSlotTimesOut(t *testing.T) {
+	qd := &queueDispatcher{freeSlots: make(chan struct{})}
+	err := qd.acquireSlot(10*time.Millisecond, make(chan struct{}))
+	if _, ok := err.(*tcpip.ErrNoBufferSpace); !ok {
+		t.Fatalf("acquireSlot() = %v, want ErrNoBufferSpace", err)
+	}
+}
+
+func TestAcquireSlotWakesOnClose(t *testing.T) {
+	qd := &queueDispatcher{freeSlots: make(chan struct{})}
+	closedCh := make(chan struct{})
+	close(closedCh)
+	err := qd.acquireSlot(0, closedCh)
+	if _, ok := err.(*tcpip.ErrClosedForSend); !ok {
+		t.Fatalf("acquireSlot() = %v, want ErrClosedForSend", err)
+	}
+}
+
+func TestAcquireSlotWakesWhenSlotFreedConcurrently(t *testing.T) {
+	qd := &queueDispatcher{freeSlots: make(chan struct{})}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		qd.freeSlots <- struct{}{}
+	}()
+	if err := qd.acquireSlot(0, make(chan struct{})); err != nil {
+		t.Fatalf("acquireSlot() = %v, want nil once a slot is freed", err)
+	}
+}
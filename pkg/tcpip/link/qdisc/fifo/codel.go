@@ -0,0 +1,141 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import (
+	"math"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// defaultCoDelTarget is the acceptable minimum sojourn time a queue may
+	// sit at before CoDel starts dropping, per the CoDel paper.
+	defaultCoDelTarget = 5 * time.Millisecond
+	// defaultCoDelInterval is the window CoDel uses to track the minimum
+	// observed sojourn time before entering the dropping state.
+	defaultCoDelInterval = 100 * time.Millisecond
+)
+
+// codelState holds the control-law state for a single queueDispatcher's
+// CoDel AQM. It is only ever touched while qd.mu is held, so it needs no
+// locking of its own.
+type codelState struct {
+	target   time.Duration
+	interval time.Duration
+
+	// firstAboveTime is one interval past the time at which the sojourn
+	// time was first seen to be >= target, i.e. the earliest time CoDel may
+	// enter the dropping state, or the zero Time if it has not been
+	// exceeded since the last time it was reset below target.
+	firstAboveTime time.Time
+	// dropping is true while CoDel is actively dropping packets at the
+	// head of the queue.
+	dropping bool
+	// dropNext is the deadline for the next drop while dropping is true.
+	dropNext time.Time
+	// count is the number of drops performed in the current dropping
+	// interval; it is used to shrink the inter-drop spacing as in the
+	// reference control law.
+	count uint32
+}
+
+func newCoDelState(target, interval time.Duration) *codelState {
+	if target <= 0 {
+		target = defaultCoDelTarget
+	}
+	if interval <= 0 {
+		interval = defaultCoDelInterval
+	}
+	return &codelState{target: target, interval: interval}
+}
+
+// shouldDrop runs the CoDel control law for a packet that sojourned for d
+// before being dequeued at now, given queue is non-empty (sojourn is
+// meaningless on an empty queue, so callers must reset state instead). It
+// returns whether the packet at the head should be dropped.
+func (c *codelState) shouldDrop(d time.Duration, now time.Time) bool {
+	ok := d < c.target
+	if ok {
+		c.firstAboveTime = time.Time{}
+		c.dropping = false
+		return false
+	}
+
+	if c.firstAboveTime.IsZero() {
+		c.firstAboveTime = now.Add(c.interval)
+		return false
+	}
+	if now.Before(c.firstAboveTime) {
+		return false
+	}
+
+	// Sojourn time has been >= target for at least interval.
+	if !c.dropping {
+		c.dropping = true
+		// Count was only decayed, not reset, per the reference
+		// implementation's re-entry heuristic: if we were dropping
+		// recently and stopped only briefly, resume near the same rate.
+		if c.count > 2 && now.Sub(c.dropNext) < 16*c.interval {
+			c.count -= 2
+		} else {
+			c.count = 1
+		}
+		c.dropNext = now.Add(c.controlLaw())
+		return true
+	}
+
+	if now.Before(c.dropNext) {
+		return false
+	}
+	c.count++
+	c.dropNext = c.dropNext.Add(c.controlLaw())
+	return true
+}
+
+// controlLaw implements interval / sqrt(count), the CoDel spacing rule that
+// makes drops increasingly frequent the longer a dropping episode persists.
+func (c *codelState) controlLaw() time.Duration {
+	return time.Duration(float64(c.interval) / math.Sqrt(float64(c.count)))
+}
+
+// codelMark CE-marks pkt's IP header for ECN if it is ECT, returning true if
+// it marked (and so the caller should enqueue/keep pkt instead of dropping
+// it). Non-ECT packets are never marked; the caller should drop them
+// instead.
+func codelMark(pkt *stack.PacketBuffer) bool {
+	switch pkt.NetworkProtocolNumber {
+	case header.IPv4ProtocolNumber:
+		h := header.IPv4(pkt.NetworkHeader().Slice())
+		tos := h.TOS()
+		if tos&header.ECNMask == header.NotECT || tos&header.ECNMask == header.CongestionExperienced {
+			return false
+		}
+		h.SetTOS(tos|header.CongestionExperienced, 0)
+		return true
+	case header.IPv6ProtocolNumber:
+		h := header.IPv6(pkt.NetworkHeader().Slice())
+		tc, _ := h.TOS()
+		if tc&header.ECNMask == header.NotECT || tc&header.ECNMask == header.CongestionExperienced {
+			return false
+		}
+		h.SetTOS(tc|header.CongestionExperienced, 0)
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCoDelShouldDropBelowTarget(t *testing.T) {
+	c := newCoDelState(5*time.Millisecond, 100*time.Millisecond)
+	now := time.Now()
+	if c.shouldDrop(time.Millisecond, now) {
+		t.Fatal("shouldDrop = true for a sojourn below target, want false")
+	}
+	if c.dropping {
+		t.Fatal("dropping = true after a below-target sojourn, want false")
+	}
+}
+
+func TestCoDelShouldDropRequiresSustainedInterval(t *testing.T) {
+	c := newCoDelState(5*time.Millisecond, 100*time.Millisecond)
+	now := time.Now()
+
+	// The first above-target sojourn only starts the interval timer; it
+	// must not drop immediately.
+	if c.shouldDrop(10*time.Millisecond, now) {
+		t.Fatal("shouldDrop = true on the first above-target sample, want false")
+	}
+	// Before the interval elapses, still no drop.
+	if c.shouldDrop(10*time.Millisecond, now.Add(50*time.Millisecond)) {
+		t.Fatal("shouldDrop = true before interval elapsed, want false")
+	}
+	// Once the interval has elapsed with sojourn still above target, CoDel
+	// must enter the dropping state.
+	if !c.shouldDrop(10*time.Millisecond, now.Add(101*time.Millisecond)) {
+		t.Fatal("shouldDrop = false after interval elapsed with sustained above-target sojourn, want true")
+	}
+	if !c.dropping {
+		t.Fatal("dropping = false after entering the dropping state, want true")
+	}
+}
+
+func TestCoDelShouldDropResetsBelowTarget(t *testing.T) {
+	c := newCoDelState(5*time.Millisecond, 100*time.Millisecond)
+	now := time.Now()
+	c.shouldDrop(10*time.Millisecond, now)
+	c.shouldDrop(10*time.Millisecond, now.Add(101*time.Millisecond))
+	if !c.dropping {
+		t.Fatal("dropping = false after entering the dropping state, want true")
+	}
+
+	// A single below-target sojourn must exit the dropping state and clear
+	// firstAboveTime.
+	if c.shouldDrop(time.Millisecond, now.Add(110*time.Millisecond)) {
+		t.Fatal("shouldDrop = true for a below-target sojourn, want false")
+	}
+	if c.dropping {
+		t.Fatal("dropping = true after a below-target sojourn, want false")
+	}
+	if !c.firstAboveTime.IsZero() {
+		t.Fatal("firstAboveTime not reset after a below-target sojourn")
+	}
+}
+
+func TestCoDelControlLawShrinksWithCount(t *testing.T) {
+	c := newCoDelState(5*time.Millisecond, 100*time.Millisecond)
+	c.count = 1
+	first := c.controlLaw()
+	c.count = 4
+	second := c.controlLaw()
+	if second >= first {
+		t.Fatalf("controlLaw() at count=4 (%v) >= count=1 (%v), want a shorter interval as count grows", second, first)
+	}
+}
@@ -18,11 +18,14 @@
 package fifo
 
 import (
+	"fmt"
 	"sync/atomic"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/sleep"
 	"gvisor.dev/gvisor/pkg/sync"
 	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
@@ -37,15 +40,50 @@ const (
 
 // discipline represents a QueueingDiscipline which implements a FIFO queue for
 // all outgoing packets. discipline can have 1 or more underlying
-// queueDispatchers. All outgoing packets are consistenly hashed to a single
-// underlying queue using the PacketBuffer.Hash if set, otherwise all packets
-// are queued to the first queue to avoid reordering in case of missing hash.
+// queueDispatchers. By default, all outgoing packets are consistently hashed
+// to a single underlying queue using the PacketBuffer.Hash if set, otherwise
+// all packets are queued to the first queue to avoid reordering in case of
+// missing hash. If a Classifier is installed via WithPriorityClasses, packets
+// are instead routed by class and a single scheduler goroutine drains the
+// per-class queues according to policy; see WithPriorityClasses.
 type discipline struct {
 	wg          sync.WaitGroup
 	dispatchers []queueDispatcher
 
 	// +checkatomic
 	closed int32
+
+	// groMaxBytes is the maximum size, in bytes, a GSO segment produced by
+	// GRO coalescing may grow to. Zero disables GRO coalescing; see
+	// WithGRO.
+	groMaxBytes int
+
+	// codelTarget and codelInterval configure CoDel AQM; see WithCoDel. A
+	// zero codelInterval disables CoDel, leaving only plain tail-drop.
+	codelTarget   time.Duration
+	codelInterval time.Duration
+	codelECN      bool
+
+	// classifier, numClasses, policy and quanta configure priority-class
+	// scheduling in place of hash sharding; see WithPriorityClasses. A nil
+	// classifier preserves the original hash-shard behavior.
+	classifier Classifier
+	numClasses int
+	policy     Policy
+	quanta     []int
+
+	// blockingWrite and blockingTimeout configure WritePacket to block
+	// when a queue is full instead of returning ErrNoBufferSpace
+	// immediately; see WithBlockingWrite.
+	blockingWrite   bool
+	blockingTimeout time.Duration
+	// closedCh is closed exactly once, by Close, to wake any WritePacket
+	// calls blocked in queueDispatcher.acquireSlot.
+	closedCh chan struct{}
+
+	// nicStats mirrors this discipline's sent/dropped totals into an
+	// embedder's own NIC-wide counters; see WithNICStats.
+	nicStats NICStatsSink
 }
 
 // queueDispatcher is responsible for dispatching all outbound packets in its
@@ -55,75 +93,265 @@ type queueDispatcher struct {
 	lower stack.LinkWriter
 	limit int
 
+	// groMaxBytes mirrors discipline.groMaxBytes; see WithGRO.
+	groMaxBytes int
+
+	// codel is non-nil when CoDel AQM is enabled for this dispatcher; see
+	// WithCoDel.
+	codel    *codelState
+	codelECN bool
+
+	// packetsDropped counts packets CoDel dropped to relieve bufferbloat;
+	// CE-marked packets are not included. overlimitDrops counts plain
+	// tail-drops when the queue was at qd.limit. closedDrops counts
+	// packets discarded because the discipline was closing. ecnMarked
+	// counts packets CE-marked instead of dropped. These, along with the
+	// remaining counters below, back the Stats snapshot; see stats.go.
+	packetsDropped atomic.Uint64
+	overlimitDrops atomic.Uint64
+	closedDrops    atomic.Uint64
+	ecnMarked      atomic.Uint64
+
+	enqueued       atomic.Uint64
+	dequeued       atomic.Uint64
+	batchesWritten atomic.Uint64
+	highWaterMark  atomic.Uint64
+	batchSizeHist  Histogram
+	sojournHist    Histogram
+
 	mu sync.Mutex
 	// +checklocks:mu
 	queue stack.PacketBufferList
 	// +checklocks:mu
 	used int
+	// enqueueTimes records, in FIFO order alongside queue, the time each
+	// packet was enqueued, for CoDel's sojourn-time calculation and the
+	// SojournTimes stat.
+	// +checklocks:mu
+	enqueueTimes []time.Time
+
+	// freeSlots is a token-per-free-slot semaphore used to implement
+	// blocking WritePacket; see WithBlockingWrite. It is nil unless
+	// blocking writes are enabled.
+	freeSlots chan struct{}
 
 	newPacketWaker sleep.Waker
 	closeWaker     sleep.Waker
+
+	// nicStats mirrors discipline.nicStats; see WithNICStats.
+	nicStats NICStatsSink
 }
 
 // New creates a new fifo queuing discipline  with the n queues with maximum
-// capacity of queueLen.
-func New(lower stack.LinkWriter, n int, queueLen int) stack.QueueingDiscipline {
+// capacity of queueLen. opts configures optional behavior such as GRO
+// coalescing or priority-class scheduling; see WithGRO and
+// WithPriorityClasses. When WithPriorityClasses is used, n is ignored in
+// favor of the configured number of classes.
+func New(lower stack.LinkWriter, n int, queueLen int, opts ...Option) stack.QueueingDiscipline {
 	d := &discipline{
-		dispatchers: make([]queueDispatcher, n),
+		closedCh: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(d)
 	}
-	// Create the required dispatchers
+	if d.classifier != nil && d.policy == PolicyDRR && len(d.quanta) != d.numClasses {
+		panic(fmt.Sprintf("fifo.New: WithPriorityClasses quanta has %d entries, want %d (numClasses) for PolicyDRR", len(d.quanta), d.numClasses))
+	}
+
+	numQueues := n
+	if d.classifier != nil {
+		numQueues = d.numClasses
+	}
+	d.dispatchers = make([]queueDispatcher, numQueues)
 	for i := range d.dispatchers {
 		qd := &d.dispatchers[i]
 		qd.lower = lower
 		qd.limit = queueLen
+		qd.groMaxBytes = d.groMaxBytes
+		qd.nicStats = d.nicStats
+		if d.codelInterval > 0 {
+			qd.codel = newCoDelState(d.codelTarget, d.codelInterval)
+			qd.codelECN = d.codelECN
+		}
+		if d.blockingWrite {
+			qd.freeSlots = make(chan struct{}, queueLen)
+			for j := 0; j < queueLen; j++ {
+				qd.freeSlots <- struct{}{}
+			}
+		}
+	}
 
+	if d.classifier != nil {
 		d.wg.Add(1)
 		go func() {
 			defer d.wg.Done()
-			qd.dispatchLoop()
+			d.schedulerLoop()
 		}()
+	} else {
+		for i := range d.dispatchers {
+			qd := &d.dispatchers[i]
+			d.wg.Add(1)
+			go func() {
+				defer d.wg.Done()
+				qd.dispatchLoop()
+			}()
+		}
 	}
 	return d
 }
 
+// drainUpTo pops packets off qd's queue, applying CoDel AQM and GRO
+// coalescing, and writes them to qd.lower in batches of up to BatchSize. It
+// stops once the queue empties or, if budget is non-negative, once at least
+// budget bytes have been written; a negative budget drains the whole queue.
+// Note that a budget of exactly 0 is not "unbounded" — it means "drain
+// nothing", which deficit round-robin relies on for a class with no deficit
+// left this round. It returns the number of bytes written, for use in
+// deficit round-robin accounting.
+func (qd *queueDispatcher) drainUpTo(budget int) int {
+	qd.mu.Lock()
+	defer qd.mu.Unlock()
+
+	var batch stack.PacketBufferList
+	// sealed is true once the current tail segment in batch has merged in
+	// a packet carrying a flush flag (PSH/FIN/URG) and so must not be
+	// extended further.
+	var sealed bool
+	// disabledSeen collects every dequeued packet DisableGRO was called
+	// on, so their groDisabled bookkeeping can be cleared once they're
+	// done being GRO merge candidates (merged away or flushed below),
+	// instead of leaking an entry for the life of the process.
+	var disabledSeen []*stack.PacketBuffer
+	defer func() {
+		for _, p := range disabledSeen {
+			groClearDisabled(p)
+		}
+	}()
+	written := 0
+	for budget < 0 || written < budget {
+		pkt, hadEntry := qd.dequeueLocked()
+		if !hadEntry {
+			break
+		}
+		if pkt == nil {
+			// Dropped by CoDel.
+			continue
+		}
+		written += pkt.Data().Size()
+		if groIsDisabled(pkt) {
+			disabledSeen = append(disabledSeen, pkt)
+		}
+
+		if tail := batch.Back(); qd.groMaxBytes > 0 && !sealed && tail != nil && groMergeable(tail, pkt, qd.groMaxBytes) {
+			groMerge(tail, pkt)
+			sealed = groFlushes(pkt)
+			pkt.DecRef()
+		} else {
+			batch.PushBack(pkt)
+			sealed = qd.groMaxBytes > 0 && groFlushes(pkt)
+		}
+
+		if batch.Len() < BatchSize && qd.used != 0 {
+			continue
+		}
+		qd.mu.Unlock()
+		qd.flush(&batch)
+		qd.mu.Lock()
+	}
+	if batch.Len() > 0 {
+		qd.mu.Unlock()
+		qd.flush(&batch)
+		qd.mu.Lock()
+	}
+	return written
+}
+
+// flush writes batch to qd.lower, records the write in qd's stats, and
+// resets batch for reuse. It must be called without qd.mu held, since
+// WritePackets may block on a slow lower link.
+func (qd *queueDispatcher) flush(batch *stack.PacketBufferList) {
+	_, _ = qd.lower.WritePackets(*batch)
+	qd.batchesWritten.Add(1)
+	qd.batchSizeHist.record(uint64(batch.Len()))
+	incNICStat(qd.nicStats.PacketsSent, uint64(batch.Len()))
+	batch.DecRef()
+	batch.Reset()
+}
+
+// dequeueLocked pops the packet at the front of qd.queue, applying CoDel AQM
+// if enabled. qd.mu must be held. It returns hadEntry=false if the queue was
+// empty, and pkt=nil with hadEntry=true if an entry was popped but CoDel
+// dropped it.
+func (qd *queueDispatcher) dequeueLocked() (pkt *stack.PacketBuffer, hadEntry bool) {
+	p := qd.queue.Front()
+	if p == nil {
+		return nil, false
+	}
+	qd.queue.Remove(p)
+	qd.used--
+	qd.dequeued.Add(1)
+	if qd.freeSlots != nil {
+		qd.freeSlots <- struct{}{}
+	}
+
+	sojourn := time.Since(qd.enqueueTimes[0])
+	qd.enqueueTimes = qd.enqueueTimes[1:]
+	qd.sojournHist.record(uint64(sojourn))
+
+	if qd.codel != nil {
+		if qd.used == 0 {
+			// Queue drained to empty; per the reference implementation
+			// this resets dropping state so a brief, already-cleared
+			// burst doesn't bias the next one.
+			qd.codel = newCoDelState(qd.codel.target, qd.codel.interval)
+		} else if qd.codel.shouldDrop(sojourn, time.Now()) {
+			if qd.codelECN && codelMark(p) {
+				qd.ecnMarked.Add(1)
+			} else {
+				qd.packetsDropped.Add(1)
+				incNICStat(qd.nicStats.PacketsDropped, 1)
+				groClearDisabled(p)
+				p.DecRef()
+				return nil, true
+			}
+		}
+	}
+	return p, true
+}
+
+// discardLocked drops every packet remaining in qd's queue without writing
+// them, for use when the discipline is closing. qd.mu must be held.
+func (qd *queueDispatcher) discardLocked() {
+	for p := qd.queue.Front(); p != nil; p = qd.queue.Front() {
+		qd.queue.Remove(p)
+		groClearDisabled(p)
+		p.DecRef()
+		qd.used--
+		qd.closedDrops.Add(1)
+		incNICStat(qd.nicStats.PacketsDropped, 1)
+	}
+	qd.queue.DecRef()
+	qd.enqueueTimes = nil
+}
+
 func (qd *queueDispatcher) dispatchLoop() {
 	s := sleep.Sleeper{}
 	s.AddWaker(&qd.newPacketWaker)
 	s.AddWaker(&qd.closeWaker)
 	defer s.Done()
 
-	var batch stack.PacketBufferList
 	for {
 		switch w := s.Fetch(true); w {
 		case &qd.newPacketWaker:
+			qd.drainUpTo(-1)
 		case &qd.closeWaker:
 			qd.mu.Lock()
-			for p := qd.queue.Front(); p != nil; p = qd.queue.Front() {
-				qd.queue.Remove(p)
-				p.DecRef()
-				qd.used--
-			}
-			qd.queue.DecRef()
+			qd.discardLocked()
 			qd.mu.Unlock()
 			return
 		default:
 			panic("unknown waker")
 		}
-		qd.mu.Lock()
-		for pkt := qd.queue.Front(); pkt != nil; pkt = qd.queue.Front() {
-			qd.queue.Remove(pkt)
-			qd.used--
-			batch.PushBack(pkt)
-			if batch.Len() < BatchSize && qd.used != 0 {
-				continue
-			}
-			qd.mu.Unlock()
-			_, _ = qd.lower.WritePackets(batch)
-			batch.DecRef()
-			batch.Reset()
-			qd.mu.Lock()
-		}
-		qd.mu.Unlock()
 	}
 }
 
@@ -133,20 +361,47 @@ func (qd *queueDispatcher) dispatchLoop() {
 //  - pkt.EgressRoute
 //  - pkt.GSOOptions
 //  - pkt.NetworkProtocolNumber
+//
+// When WithGRO is enabled, call DisableGRO(pkt) beforehand to opt a
+// specific packet out of coalescing.
 func (d *discipline) WritePacket(pkt *stack.PacketBuffer) tcpip.Error {
 	if atomic.LoadInt32(&d.closed) == qDiscClosed {
 		return &tcpip.ErrClosedForSend{}
 	}
-	qd := &d.dispatchers[int(pkt.Hash)%len(d.dispatchers)]
+	idx := int(pkt.Hash) % len(d.dispatchers)
+	if d.classifier != nil {
+		if idx = d.classifier(pkt) % len(d.dispatchers); idx < 0 {
+			idx += len(d.dispatchers)
+		}
+	}
+	qd := &d.dispatchers[idx]
+
+	if qd.freeSlots != nil {
+		if err := qd.acquireSlot(d.blockingTimeout, d.closedCh); err != nil {
+			if _, ok := err.(*tcpip.ErrNoBufferSpace); ok {
+				qd.overlimitDrops.Add(1)
+				incNICStat(qd.nicStats.PacketsDropped, 1)
+			}
+			groClearDisabled(pkt)
+			return err
+		}
+	}
+
 	qd.mu.Lock()
-	haveSpace := qd.used < qd.limit
+	haveSpace := qd.freeSlots != nil || qd.used < qd.limit
 	if haveSpace {
 		pkt.IncRef()
 		qd.queue.PushBack(pkt)
 		qd.used++
+		qd.enqueueTimes = append(qd.enqueueTimes, time.Now())
+		qd.enqueued.Add(1)
+		qd.updateHighWaterMark(qd.used)
 	}
 	qd.mu.Unlock()
 	if !haveSpace {
+		qd.overlimitDrops.Add(1)
+		incNICStat(qd.nicStats.PacketsDropped, 1)
+		groClearDisabled(pkt)
 		return &tcpip.ErrNoBufferSpace{}
 	}
 	qd.newPacketWaker.Assert()
@@ -154,7 +409,10 @@ func (d *discipline) WritePacket(pkt *stack.PacketBuffer) tcpip.Error {
 }
 
 func (d *discipline) Close() {
-	atomic.StoreInt32(&d.closed, qDiscClosed)
+	if !atomic.CompareAndSwapInt32(&d.closed, 0, qDiscClosed) {
+		return
+	}
+	close(d.closedCh)
 	for i := range d.dispatchers {
 		d.dispatchers[i].closeWaker.Assert()
 	}
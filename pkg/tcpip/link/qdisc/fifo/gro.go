@@ -0,0 +1,171 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import (
+	"gvisor.dev/gvisor/pkg/sync"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// defaultGROMaxBytes bounds the size of a single coalesced GSO segment when
+// WithGRO is enabled without an explicit cap. It matches the software GSO
+// ceiling used elsewhere in the stack.
+const defaultGROMaxBytes = 64 << 10
+
+// groFlushFlags are the TCP flags that carry segment-boundary semantics and
+// so force the current coalescing run to close once a segment carrying them
+// has been merged in, rather than being smeared silently into a larger
+// segment.
+const groFlushFlags = header.TCPFlagFin | header.TCPFlagPsh | header.TCPFlagUrg
+
+// groDisabled tracks the PacketBuffers, by pointer identity, that DisableGRO
+// has opted out of coalescing. stack.PacketBuffer has no spare field for
+// this package to stash an opt-out bit on directly, so the opt-out lives
+// here instead: entries are added by DisableGRO before the packet is handed
+// to WritePacket and removed no later than the packet leaving drainUpTo
+// (merged away or handed to the lower LinkWriter) or being dropped, so the
+// map never holds more entries than there are in-flight opted-out packets.
+var groDisabled sync.Map
+
+// DisableGRO opts pkt out of GRO coalescing for dispositions configured with
+// WithGRO, so that e.g. a caller that needs a packet to reach the wire
+// unmodified can still share a discipline with coalesced traffic. It must
+// be called before handing pkt to WritePacket.
+func DisableGRO(pkt *stack.PacketBuffer) {
+	groDisabled.Store(pkt, struct{}{})
+}
+
+// groIsDisabled reports whether DisableGRO was called for pkt.
+func groIsDisabled(pkt *stack.PacketBuffer) bool {
+	_, disabled := groDisabled.Load(pkt)
+	return disabled
+}
+
+// groClearDisabled removes pkt's DisableGRO bookkeeping, if any. Callers
+// must call this once pkt is done being a GRO merge candidate: merged away,
+// handed to the lower LinkWriter, or dropped without ever being queued.
+func groClearDisabled(pkt *stack.PacketBuffer) {
+	groDisabled.Delete(pkt)
+}
+
+// groMergeable reports whether next can be appended to the end of tail to
+// extend a single GSO segment: same egress route and network protocol, same
+// TCP 4-tuple, contiguous sequence numbers, matching IP TOS/TTL/options, and
+// the merged size would stay within maxBytes. tail.GSOOptions.Type ==
+// GSONone is the ordinary, not-yet-coalesced starting state, not an opt-out
+// — groMerge promotes tail to a GSO segment on the first successful merge.
+// next is rejected if it already describes its own GSO segment (nothing to
+// gain by extending a segment that was already built above us), or if
+// either packet was passed to DisableGRO to opt out explicitly.
+func groMergeable(tail, next *stack.PacketBuffer, maxBytes int) bool {
+	if tail.TransportProtocolNumber != header.TCPProtocolNumber {
+		return false
+	}
+	if groIsDisabled(tail) || groIsDisabled(next) {
+		return false
+	}
+	if tail.NetworkProtocolNumber != next.NetworkProtocolNumber ||
+		tail.TransportProtocolNumber != next.TransportProtocolNumber {
+		return false
+	}
+	if tail.EgressRoute.RemoteLinkAddress != next.EgressRoute.RemoteLinkAddress ||
+		tail.EgressRoute.LocalAddress != next.EgressRoute.LocalAddress ||
+		tail.EgressRoute.RemoteAddress != next.EgressRoute.RemoteAddress {
+		return false
+	}
+	if next.GSOOptions.Type != stack.GSONone {
+		// next already describes its own GSO segment; nothing to extend.
+		return false
+	}
+
+	tailTCP := header.TCP(tail.TransportHeader().Slice())
+	nextTCP := header.TCP(next.TransportHeader().Slice())
+	if tailTCP.SourcePort() != nextTCP.SourcePort() || tailTCP.DestinationPort() != nextTCP.DestinationPort() {
+		return false
+	}
+	if tailTCP.Flags()&groFlushFlags != 0 {
+		// tail was already sealed by a previous flush-flagged merge.
+		return false
+	}
+	if tailTCP.SequenceNumber()+uint32(tail.Data().Size()) != nextTCP.SequenceNumber() {
+		return false
+	}
+
+	tailIPOpts, tailTOS, tailTTL, ok1 := ipAttrs(tail)
+	nextIPOpts, nextTOS, nextTTL, ok2 := ipAttrs(next)
+	if !ok1 || !ok2 || tailTOS != nextTOS || tailTTL != nextTTL || string(tailIPOpts) != string(nextIPOpts) {
+		return false
+	}
+
+	return tail.Data().Size()+next.Data().Size() <= maxBytes
+}
+
+// ipAttrs extracts the IP options (if any), TOS/traffic-class and TTL/hop
+// limit of pkt's network header, for the IP version matching
+// pkt.NetworkProtocolNumber.
+func ipAttrs(pkt *stack.PacketBuffer) (opts []byte, tos uint8, ttl uint8, ok bool) {
+	switch pkt.NetworkProtocolNumber {
+	case header.IPv4ProtocolNumber:
+		h := header.IPv4(pkt.NetworkHeader().Slice())
+		return h.Options(), h.TOS(), h.TTL(), true
+	case header.IPv6ProtocolNumber:
+		h := header.IPv6(pkt.NetworkHeader().Slice())
+		tc, _ := h.TOS()
+		return nil, tc, h.HopLimit(), true
+	default:
+		return nil, 0, 0, false
+	}
+}
+
+// groFlushes reports whether pkt carries a TCP flag that forces the
+// coalescing run it was merged into (or would start) to close immediately.
+// Non-TCP packets never flush since they are never GRO candidates.
+func groFlushes(pkt *stack.PacketBuffer) bool {
+	if pkt.TransportProtocolNumber != header.TCPProtocolNumber {
+		return false
+	}
+	return header.TCP(pkt.TransportHeader().Slice()).Flags()&groFlushFlags != 0
+}
+
+// groMerge appends next's TCP payload onto tail and promotes tail to
+// describe a single merged GSO segment, recording tail's original segment
+// size as the MSS on the first merge so the lower link writer can still split it into
+// wire-sized segments. next's flush flags (PSH/FIN/URG), if any, are OR'd
+// into tail's TCP header so they still reach the wire once merged, instead
+// of being silently dropped along with the rest of next's header. The
+// caller is responsible for dropping next (it must not be separately
+// written or re-queued once merged).
+func groMerge(tail, next *stack.PacketBuffer) {
+	if tail.GSOOptions.Type == stack.GSONone {
+		gsoType := stack.GSOTCPv4
+		if tail.NetworkProtocolNumber == header.IPv6ProtocolNumber {
+			gsoType = stack.GSOTCPv6
+		}
+		tail.GSOOptions = stack.GSOOptions{
+			Type:       gsoType,
+			NeedsCsum:  true,
+			CsumOffset: header.TCPChecksumOffset,
+			MSS:        uint16(tail.Data().Size()),
+			L3HdrLen:   uint16(len(tail.NetworkHeader().Slice())),
+		}
+	}
+	tailTCP := header.TCP(tail.TransportHeader().Slice())
+	nextTCP := header.TCP(next.TransportHeader().Slice())
+	if flushFlags := nextTCP.Flags() & groFlushFlags; flushFlags != 0 {
+		tailTCP.SetFlags(uint8(tailTCP.Flags() | flushFlags))
+	}
+	tail.Data().Merge(next.Data())
+}
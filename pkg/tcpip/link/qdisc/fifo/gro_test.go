@@ -0,0 +1,135 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+var (
+	testSrcAddr = tcpip.AddrFromSlice([]byte{192, 168, 0, 1})
+	testDstAddr = tcpip.AddrFromSlice([]byte{192, 168, 0, 2})
+)
+
+// newTCPSegment builds a minimal IPv4/TCP PacketBuffer carrying dataLen bytes
+// of payload at seq, for exercising groMergeable/groMerge without a full
+// stack.
+func newTCPSegment(seq uint32, dataLen int, flags header.TCPFlags) *stack.PacketBuffer {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes: header.IPv4MinimumSize + header.TCPMinimumSize,
+		Payload:            buffer.MakeWithData(make([]byte, dataLen)),
+	})
+	pkt.NetworkProtocolNumber = header.IPv4ProtocolNumber
+	pkt.TransportProtocolNumber = header.TCPProtocolNumber
+	pkt.EgressRoute = stack.RouteInfo{
+		RemoteLinkAddress: tcpip.LinkAddress("\x00\x00\x00\x00\x00\x01"),
+		LocalAddress:      testSrcAddr,
+		RemoteAddress:     testDstAddr,
+	}
+
+	ip := header.IPv4(pkt.NetworkHeader().Push(header.IPv4MinimumSize))
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(header.IPv4MinimumSize + header.TCPMinimumSize + dataLen),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     testSrcAddr,
+		DstAddr:     testDstAddr,
+	})
+
+	tcp := header.TCP(pkt.TransportHeader().Push(header.TCPMinimumSize))
+	tcp.Encode(&header.TCPFields{
+		SrcPort:    1234,
+		DstPort:    80,
+		SeqNum:     seq,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	return pkt
+}
+
+func TestGROMergeableContiguousSegments(t *testing.T) {
+	tail := newTCPSegment(0, 100, 0)
+	next := newTCPSegment(100, 100, 0)
+	if !groMergeable(tail, next, defaultGROMaxBytes) {
+		t.Fatal("groMergeable = false for two contiguous same-flow segments, want true")
+	}
+}
+
+func TestGROMergeableRejectsNonContiguousSequence(t *testing.T) {
+	tail := newTCPSegment(0, 100, 0)
+	next := newTCPSegment(150, 100, 0)
+	if groMergeable(tail, next, defaultGROMaxBytes) {
+		t.Fatal("groMergeable = true for a gap in the sequence space, want false")
+	}
+}
+
+func TestGROMergeableRejectsDisableGRO(t *testing.T) {
+	tail := newTCPSegment(0, 100, 0)
+	next := newTCPSegment(100, 100, 0)
+	DisableGRO(next)
+	defer groClearDisabled(next)
+	if groMergeable(tail, next, defaultGROMaxBytes) {
+		t.Fatal("groMergeable = true for a packet passed to DisableGRO, want false")
+	}
+}
+
+func TestGROMergeableRejectsOversizeMerge(t *testing.T) {
+	tail := newTCPSegment(0, 100, 0)
+	next := newTCPSegment(100, 100, 0)
+	if groMergeable(tail, next, 150) {
+		t.Fatal("groMergeable = true for a merge exceeding maxBytes, want false")
+	}
+}
+
+func TestGROMergePromotesFirstMergeToGSO(t *testing.T) {
+	tail := newTCPSegment(0, 100, 0)
+	next := newTCPSegment(100, 100, 0)
+	if tail.GSOOptions.Type != stack.GSONone {
+		t.Fatalf("tail.GSOOptions.Type = %v before any merge, want GSONone", tail.GSOOptions.Type)
+	}
+	groMerge(tail, next)
+	if tail.GSOOptions.Type != stack.GSOTCPv4 {
+		t.Fatalf("tail.GSOOptions.Type = %v after the first merge, want GSOTCPv4", tail.GSOOptions.Type)
+	}
+	if got, want := tail.Data().Size(), 200; got != want {
+		t.Fatalf("tail.Data().Size() = %d after merge, want %d", got, want)
+	}
+}
+
+func TestGROMergePreservesFlushFlags(t *testing.T) {
+	tail := newTCPSegment(0, 100, 0)
+	next := newTCPSegment(100, 50, header.TCPFlagFin|header.TCPFlagAck)
+	groMerge(tail, next)
+
+	tailTCP := header.TCP(tail.TransportHeader().Slice())
+	if tailTCP.Flags()&header.TCPFlagFin == 0 {
+		t.Fatal("merged tail lost next's FIN flag; it will never reach the wire")
+	}
+}
+
+func TestGROFlushesOnFlushFlags(t *testing.T) {
+	if !groFlushes(newTCPSegment(0, 100, header.TCPFlagFin)) {
+		t.Fatal("groFlushes = false for a FIN segment, want true")
+	}
+	if groFlushes(newTCPSegment(0, 100, header.TCPFlagAck)) {
+		t.Fatal("groFlushes = true for a plain ACK segment, want false")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import "time"
+
+// Option configures optional behavior of a discipline created via New. The
+// zero value of discipline (no options applied) preserves the historical
+// plain-FIFO, tail-drop behavior.
+type Option func(*discipline)
+
+// WithGRO enables transmit-side GRO coalescing across every dispatcher of
+// the discipline. When enabled, dispatchLoop opportunistically merges
+// consecutive, same-flow PacketBuffers it pops off the queue into a single
+// GSO segment before handing the batch to the lower LinkWriter, instead of
+// writing one PacketBuffer per segment. maxBytes bounds the size a merged
+// segment may grow to; if maxBytes <= 0, defaultGROMaxBytes is used.
+func WithGRO(enabled bool, maxBytes int) Option {
+	return func(d *discipline) {
+		if !enabled {
+			d.groMaxBytes = 0
+			return
+		}
+		if maxBytes <= 0 {
+			maxBytes = defaultGROMaxBytes
+		}
+		d.groMaxBytes = maxBytes
+	}
+}
+
+// WithCoDel adds CoDel active queue management to every dispatcher of the
+// discipline: packets are dropped from the head once the minimum sojourn
+// time observed over interval has stayed at or above target, per the CoDel
+// control law. Packets are still tail-dropped once a queue is at its limit. A zero target or interval falls
+// back to defaultCoDelTarget/defaultCoDelInterval. If ecn is true, packets
+// that are ECN-capable (ECT) are CE-marked instead of dropped whenever
+// CoDel decides to act on them.
+func WithCoDel(target, interval time.Duration, ecn bool) Option {
+	return func(d *discipline) {
+		if target <= 0 {
+			target = defaultCoDelTarget
+		}
+		if interval <= 0 {
+			interval = defaultCoDelInterval
+		}
+		d.codelTarget = target
+		d.codelInterval = interval
+		d.codelECN = ecn
+	}
+}
+
+// WithBlockingWrite makes WritePacket block for up to timeout (or
+// indefinitely if timeout <= 0) when a dispatcher's queue is full, instead
+// of immediately returning ErrNoBufferSpace. A blocked WritePacket wakes as
+// soon as dispatchLoop dequeues a packet to make room, the timeout elapses,
+// or the discipline is closed (in which case it returns ErrClosedForSend).
+// This lets embedders whose lower LinkWriter is a slow consumer (e.g. a
+// userspace TUN) apply true end-to-end backpressure to senders instead of
+// relying on retransmits after silent drops.
+func WithBlockingWrite(timeout time.Duration) Option {
+	return func(d *discipline) {
+		d.blockingWrite = true
+		d.blockingTimeout = timeout
+	}
+}
+
+// WithNICStats wires this discipline's sent/dropped packet totals into
+// sink, which an embedder typically populates with counters drawn from its
+// own NIC's tcpip.Stats (e.g. nic.stats.Tx.Packets and nic.stats.Tx.Dropped),
+// so this package's activity is also visible through the NIC-wide stats
+// callers already scrape. The richer per-dispatcher stats (histograms,
+// per-reason drop counts, high water marks) remain available only through
+// Stats; sink only ever sees the coarse sent/dropped totals.
+func WithNICStats(sink NICStatsSink) Option {
+	return func(d *discipline) {
+		d.nicStats = sink
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import (
+	"gvisor.dev/gvisor/pkg/sleep"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Classifier maps a packet to a dispatcher class in [0, numClasses). Classes
+// are ordered from highest to lowest priority under PolicyStrictPriority;
+// the ordering is immaterial under PolicyDRR.
+type Classifier func(pkt *stack.PacketBuffer) int
+
+// Policy selects how a discipline configured with WithPriorityClasses
+// schedules its per-class queues.
+type Policy int
+
+const (
+	// PolicyStrictPriority fully drains class 0, then class 1, and so on,
+	// before moving to the next lower-priority class, re-checking from
+	// class 0 after every class empties. A sustained class 0 flow can
+	// therefore starve lower classes entirely.
+	PolicyStrictPriority Policy = iota
+	// PolicyDRR schedules classes with deficit round-robin: each class
+	// accrues its quantum (in bytes) every round, and may send until its
+	// accumulated deficit is exhausted, with unused deficit carried over
+	// to the next round.
+	PolicyDRR
+)
+
+// WithPriorityClasses replaces the default hash-shard routing with
+// class-based scheduling: classifier maps each outgoing packet to one of
+// numClasses queues, and a single scheduler goroutine drains those queues
+// according to policy instead of one independent goroutine per queue. Under
+// PolicyDRR, quanta gives the per-class quantum in bytes and must have
+// numClasses entries; it is ignored under PolicyStrictPriority and may be
+// nil.
+func WithPriorityClasses(classifier Classifier, numClasses int, policy Policy, quanta []int) Option {
+	return func(d *discipline) {
+		d.classifier = classifier
+		d.numClasses = numClasses
+		d.policy = policy
+		d.quanta = quanta
+	}
+}
+
+// DSCPClassifier classifies pkt by its IP DSCP code point, collapsing the
+// 6-bit DSCP space into four priority bands: network control (CS6/CS7) in
+// class 0, expedited forwarding (EF) and voice-admit in class 1, assured
+// forwarding and CS1-CS5 in class 2, and best-effort/default in class 3.
+// Non-IP packets classify as class 3.
+func DSCPClassifier(pkt *stack.PacketBuffer) int {
+	var dscp uint8
+	switch pkt.NetworkProtocolNumber {
+	case header.IPv4ProtocolNumber:
+		dscp = header.IPv4(pkt.NetworkHeader().Slice()).TOS() >> 2
+	case header.IPv6ProtocolNumber:
+		tos, _ := header.IPv6(pkt.NetworkHeader().Slice()).TOS()
+		dscp = tos >> 2
+	default:
+		return 3
+	}
+	switch {
+	case dscp >= 48: // CS6, CS7: network control.
+		return 0
+	case dscp == 46 || dscp == 44: // EF, voice-admit.
+		return 1
+	case dscp >= 8: // CS1-CS5, AFxx.
+		return 2
+	default: // CS0/default.
+		return 3
+	}
+}
+
+// TCPControlClassifier places TCP control segments (SYN, FIN, RST, or pure
+// ACKs with no payload) in class 0 and all other traffic, including bulk
+// data, in class 1, so interactive and control traffic isn't head-of-line
+// blocked behind bulk flows that happen to share a hash bucket. Non-TCP
+// packets classify as class 1.
+func TCPControlClassifier(pkt *stack.PacketBuffer) int {
+	if pkt.TransportProtocolNumber != header.TCPProtocolNumber {
+		return 1
+	}
+	tcp := header.TCP(pkt.TransportHeader().Slice())
+	const controlFlags = header.TCPFlagSyn | header.TCPFlagFin | header.TCPFlagRst
+	if tcp.Flags()&controlFlags != 0 {
+		return 0
+	}
+	if tcp.Flags()&header.TCPFlagAck != 0 && pkt.Data().Size() == 0 {
+		return 0
+	}
+	return 1
+}
+
+// isCloseWaker reports whether w is the closeWaker of any of d's
+// dispatchers, all of which schedulerLoop listens on so that Close wakes it
+// regardless of which dispatcher index Close happens to assert first.
+func (d *discipline) isCloseWaker(w *sleep.Waker) bool {
+	for i := range d.dispatchers {
+		if w == &d.dispatchers[i].closeWaker {
+			return true
+		}
+	}
+	return false
+}
+
+// schedulerLoop drains d's per-class dispatchers according to d.policy. It
+// replaces the one-goroutine-per-dispatcher model used for hash sharding,
+// since priority ordering across classes requires a single scheduler.
+func (d *discipline) schedulerLoop() {
+	s := sleep.Sleeper{}
+	for i := range d.dispatchers {
+		s.AddWaker(&d.dispatchers[i].newPacketWaker)
+		s.AddWaker(&d.dispatchers[i].closeWaker)
+	}
+	defer s.Done()
+
+	deficit := make([]int, len(d.dispatchers))
+	for {
+		w := s.Fetch(true)
+		if d.isCloseWaker(w) {
+			for i := range d.dispatchers {
+				qd := &d.dispatchers[i]
+				qd.mu.Lock()
+				qd.discardLocked()
+				qd.mu.Unlock()
+			}
+			return
+		}
+
+		switch d.policy {
+		case PolicyStrictPriority:
+			for i := 0; i < len(d.dispatchers); i++ {
+				d.dispatchers[i].drainUpTo(-1)
+				// Class i is empty now; start over from class 0 if a
+				// higher-priority class received packets meanwhile.
+				for j := 0; j < i; j++ {
+					qd := &d.dispatchers[j]
+					qd.mu.Lock()
+					pending := qd.used != 0
+					qd.mu.Unlock()
+					if pending {
+						i = -1
+						break
+					}
+				}
+			}
+		case PolicyDRR:
+			for i := range d.dispatchers {
+				qd := &d.dispatchers[i]
+				qd.mu.Lock()
+				empty := qd.used == 0
+				qd.mu.Unlock()
+				if empty {
+					deficit[i] = 0
+					continue
+				}
+				deficit[i] += d.quanta[i]
+				if deficit[i] < 0 {
+					// Still paying back an earlier overspend; a negative
+					// budget would make drainUpTo drain the whole queue.
+					continue
+				}
+				sent := qd.drainUpTo(deficit[i])
+				// Overspend (drainUpTo always finishes the packet it's
+				// partway through, so it can write a little past budget)
+				// carries over as a negative deficit and is deducted from
+				// next round's quantum, per standard DRR; it must not be
+				// clamped to zero, or an overspending class would never be
+				// penalized and would get more than its fair share.
+				deficit[i] -= sent
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import (
+	"math/bits"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// numHistogramBuckets bounds the Histogram bucket count. Bucket 0 holds
+// exactly-zero samples; bucket i (i >= 1) holds samples in [2^(i-1), 2^i).
+// The top bucket additionally absorbs any sample too large to fit.
+const numHistogramBuckets = 20
+
+// Histogram is a lock-free, power-of-two bucketed histogram. It is cheap
+// enough to update on the WritePacket/dispatchLoop fast path: every
+// operation is a single atomic increment, with no mutex of its own.
+type Histogram struct {
+	buckets [numHistogramBuckets]atomic.Uint64
+}
+
+func (h *Histogram) record(v uint64) {
+	i := 0
+	if v > 0 {
+		i = bits.Len64(v)
+		if i >= numHistogramBuckets {
+			i = numHistogramBuckets - 1
+		}
+	}
+	h.buckets[i].Add(1)
+}
+
+// Counts returns a snapshot of the histogram's per-bucket sample counts.
+func (h *Histogram) Counts() [numHistogramBuckets]uint64 {
+	var out [numHistogramBuckets]uint64
+	for i := range h.buckets {
+		out[i] = h.buckets[i].Load()
+	}
+	return out
+}
+
+// DropStats breaks down a dispatcher's dropped-packet count by reason.
+type DropStats struct {
+	// OverLimit counts packets tail-dropped because the queue was at its
+	// configured limit.
+	OverLimit uint64
+	// Closed counts packets discarded because the discipline was closing.
+	Closed uint64
+	// AQM counts packets CoDel dropped to relieve bufferbloat.
+	AQM uint64
+}
+
+// DispatcherStats is a point-in-time snapshot of one dispatcher's counters.
+type DispatcherStats struct {
+	Enqueued       uint64
+	Dequeued       uint64
+	Dropped        DropStats
+	ECNMarked      uint64
+	CurrentDepth   int
+	HighWaterMark  int
+	BatchesWritten uint64
+	// BatchSizes is a histogram of the number of packets per call to the
+	// lower LinkWriter's WritePackets.
+	BatchSizes [numHistogramBuckets]uint64
+	// SojournTimes is a histogram, in nanoseconds, of how long packets sat
+	// queued before being dequeued.
+	SojournTimes [numHistogramBuckets]uint64
+}
+
+// Stats is implemented by QueueingDisciplines that expose per-dispatcher
+// diagnostic counters, such as the one returned by New.
+type Stats interface {
+	Stats() []DispatcherStats
+}
+
+var _ Stats = (*discipline)(nil)
+
+// Stats returns a snapshot of every dispatcher's counters, in dispatcher
+// (shard or class) order.
+func (d *discipline) Stats() []DispatcherStats {
+	out := make([]DispatcherStats, len(d.dispatchers))
+	for i := range d.dispatchers {
+		out[i] = d.dispatchers[i].stats()
+	}
+	return out
+}
+
+func (qd *queueDispatcher) stats() DispatcherStats {
+	qd.mu.Lock()
+	depth := qd.used
+	qd.mu.Unlock()
+	return DispatcherStats{
+		Enqueued: qd.enqueued.Load(),
+		Dequeued: qd.dequeued.Load(),
+		Dropped: DropStats{
+			OverLimit: qd.overlimitDrops.Load(),
+			Closed:    qd.closedDrops.Load(),
+			AQM:       qd.packetsDropped.Load(),
+		},
+		ECNMarked:      qd.ecnMarked.Load(),
+		CurrentDepth:   depth,
+		HighWaterMark:  int(qd.highWaterMark.Load()),
+		BatchesWritten: qd.batchesWritten.Load(),
+		BatchSizes:     qd.batchSizeHist.Counts(),
+		SojournTimes:   qd.sojournHist.Counts(),
+	}
+}
+
+// NICStatsSink is the subset of a NIC's tcpip.Stats counters this package
+// can keep synchronized as it writes and drops packets, so that this
+// discipline's activity also shows up in the coarser, NIC-wide counters
+// callers already scrape instead of only through Stats. Either field may
+// be left nil to skip that counter. See WithNICStats.
+type NICStatsSink struct {
+	// PacketsSent is incremented by the number of packets actually handed
+	// to the lower LinkWriter, typically an embedder's nic.stats.Tx.Packets.
+	PacketsSent *tcpip.StatCounter
+	// PacketsDropped is incremented for every packet this discipline drops,
+	// regardless of reason (queue full, CoDel AQM, or discipline closing),
+	// typically an embedder's nic.stats.Tx.Dropped.
+	PacketsDropped *tcpip.StatCounter
+}
+
+// incNICStat increments c by n if c is non-nil, so call sites don't each
+// need to guard against an unset NICStatsSink field.
+func incNICStat(c *tcpip.StatCounter, n uint64) {
+	if c != nil {
+		c.IncrementBy(n)
+	}
+}
+
+// updateHighWaterMark records depth as qd's new high water mark if it
+// exceeds the previous one. It is lock-free so it can run with qd.mu held
+// on the WritePacket fast path without adding contention.
+func (qd *queueDispatcher) updateHighWaterMark(depth int) {
+	for {
+		cur := qd.highWaterMark.Load()
+		if uint64(depth) <= cur {
+			return
+		}
+		if qd.highWaterMark.CompareAndSwap(cur, uint64(depth)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+func TestHistogramRecordsIntoExpectedBucket(t *testing.T) {
+	tests := []struct {
+		v    uint64
+		want int
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 2},
+		{3, 2},
+		{4, 3},
+		{1023, 10},
+	}
+	for _, test := range tests {
+		var h Histogram
+		h.record(test.v)
+		counts := h.Counts()
+		if counts[test.want] != 1 {
+			t.Errorf("record(%d): bucket %d = %d, want 1 (counts=%v)", test.v, test.want, counts[test.want], counts)
+		}
+	}
+}
+
+func TestHistogramClampsOversizeSamples(t *testing.T) {
+	var h Histogram
+	h.record(^uint64(0))
+	counts := h.Counts()
+	if counts[numHistogramBuckets-1] != 1 {
+		t.Errorf("record(max uint64): top bucket = %d, want 1", counts[numHistogramBuckets-1])
+	}
+}
+
+func TestIncNICStatNilSink(t *testing.T) {
+	// Must not panic when the counter is unset; WithNICStats is optional.
+	incNICStat(nil, 5)
+}
+
+func TestIncNICStat(t *testing.T) {
+	var c tcpip.StatCounter
+	incNICStat(&c, 3)
+	incNICStat(&c, 4)
+	if got, want := c.Value(), uint64(7); got != want {
+		t.Errorf("counter value = %d, want %d", got, want)
+	}
+}